@@ -204,6 +204,25 @@ func (c *Client) GetContainerIP(nameOrID string) (string, error) {
 	return info.NetworkSettings.IPAddress, nil
 }
 
+const (
+	defaultBridgeName       = "docker0"
+	bridgeNameNetworkOption = "com.docker.network.bridge.name"
+)
+
+// AutodiscoverDockerBridge returns the name of the Linux bridge behind
+// Docker's default "bridge" network, which is docker0 unless the daemon
+// was told otherwise
+func (c *Client) AutodiscoverDockerBridge() (string, error) {
+	network, err := c.NetworkInfo("bridge")
+	if err != nil {
+		return "", err
+	}
+	if name, found := network.Options[bridgeNameNetworkOption]; found && name != "" {
+		return name, nil
+	}
+	return defaultBridgeName, nil
+}
+
 // logging
 
 func (c *Client) errorf(fmt string, args ...interface{}) {
@@ -3,8 +3,10 @@ package odp
 import (
 	"fmt"
 	"net"
+	"sort"
 	"syscall"
 
+	"github.com/vishvananda/netlink"
 	"github.com/weaveworks/go-odp/odp"
 )
 
@@ -84,3 +86,83 @@ func AddDatapathInterface(dpname string, ifname string) error {
 	_, err = dp.CreateVport(odp.NewNetdevVportSpec(ifname))
 	return err
 }
+
+// Like AddDatapathInterface, but succeed if the interface is already
+// attached to the datapath
+func EnsureDatapathInterface(dpname string, ifname string) error {
+	dpif, err := odp.NewDpif()
+	if err != nil {
+		return err
+	}
+	defer dpif.Close()
+
+	dp, err := dpif.LookupDatapath(dpname)
+	if err != nil {
+		return err
+	}
+
+	vports, err := dp.EnumerateVports()
+	if err != nil {
+		return err
+	}
+	for _, vport := range vports {
+		if vport.Spec.Name() == ifname {
+			return nil
+		}
+	}
+
+	_, err = dp.CreateVport(odp.NewNetdevVportSpec(ifname))
+	return err
+}
+
+type DatapathInfo struct {
+	Name  string
+	MTU   int
+	Ports int // interfaces attached to the datapath as netdev vports
+}
+
+// Find all ODP datapaths in the current network namespace.  Ask the
+// kernel's openvswitch module rather than looking for links of type
+// "openvswitch", since older kernels show datapaths as plain devices.
+func ListDatapaths() ([]DatapathInfo, error) {
+	dpif, err := odp.NewDpif()
+	if err != nil {
+		if odp.IsKernelLacksODPError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer dpif.Close()
+
+	dps, err := dpif.EnumerateDatapaths()
+	if err != nil {
+		return nil, err
+	}
+	var datapaths []DatapathInfo
+	for name, dp := range dps {
+		// The datapath's internal port is the link of the same name
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, err
+		}
+		info := DatapathInfo{Name: name, MTU: link.Attrs().MTU}
+		vports, err := dp.EnumerateVports()
+		if err != nil {
+			return nil, err
+		}
+		for _, vport := range vports {
+			if vport.Spec.TypeName() == "netdev" {
+				info.Ports++
+			}
+		}
+		datapaths = append(datapaths, info)
+	}
+	sort.Sort(byName(datapaths))
+	return datapaths, nil
+}
+
+type byName []DatapathInfo
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
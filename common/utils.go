@@ -1,10 +1,19 @@
 package common
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
@@ -19,6 +28,13 @@ func Assert(test bool) {
 	}
 }
 
+// Assert test is true, panic with the formatted message otherwise
+func Assertf(test bool, format string, args ...interface{}) {
+	if !test {
+		panic("Assertion failure: " + fmt.Sprintf(format, args...))
+	}
+}
+
 func ErrorMessages(errors []error) string {
 	var result []string
 	for _, err := range errors {
@@ -31,6 +47,42 @@ type NetDev struct {
 	Name  string
 	MAC   net.HardwareAddr
 	CIDRs []*net.IPNet
+
+	// Link-layer counters as reported by the kernel; zero for
+	// devices that do not keep statistics
+	RXBytes  uint64
+	TXBytes  uint64
+	RXErrors uint64
+	TXErrors uint64
+}
+
+// A set of interfaces, e.g. as found by FindNetDevs
+type NetDevList []NetDev
+
+// The interfaces having an address inside subnet
+func (l NetDevList) FilterByCIDR(subnet *net.IPNet) NetDevList {
+	var result NetDevList
+	for _, netDev := range l {
+		for _, cidr := range netDev.CIDRs {
+			if subnet.Contains(cidr.IP) {
+				result = append(result, netDev)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// The interfaces whose name matches a shell pattern such as "veth*",
+// as for path.Match.  A malformed pattern matches nothing.
+func (l NetDevList) FilterByName(pattern string) NetDevList {
+	var result NetDevList
+	for _, netDev := range l {
+		if matched, _ := path.Match(pattern, netDev.Name); matched {
+			result = append(result, netDev)
+		}
+	}
+	return result
 }
 
 // Search the network namespace of a process for interfaces matching a predicate
@@ -62,6 +114,248 @@ func FindNetDevs(processID int, match func(link netlink.Link) bool) ([]NetDev, e
 	return netDevs, err
 }
 
+// Search the network namespaces of all containers for interfaces
+// matching a predicate.  Each namespace is scanned once, and its
+// interfaces are reported against the first process found in it;
+// processes in the host namespace are skipped.
+func FindNetDevsAllContainers(match func(netlink.Link) bool) (map[int][]NetDev, error) {
+	hostNS, err := netNSInode(1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read root namespace: %s", err)
+	}
+	pids, err := processesByNetNS()
+	if err != nil {
+		return nil, err
+	}
+	delete(pids, hostNS)
+
+	var toScan []int
+	for _, pid := range pids {
+		toScan = append(toScan, pid)
+	}
+	return scanNetNSs(toScan, match)
+}
+
+// Search the network namespaces of the given processes for interfaces
+// matching a predicate.  Processes sharing a namespace all get the
+// result of a single scan.
+func FindNetDevsForPIDs(processIDs []int, match func(netlink.Link) bool) (map[int][]NetDev, error) {
+	sharers := make(map[string][]int) // namespace inode -> processes in it
+	var toScan []int
+	for _, pid := range processIDs {
+		inode, err := netNSInode(pid)
+		if err != nil {
+			continue // process has gone away
+		}
+		if _, found := sharers[inode]; !found {
+			toScan = append(toScan, pid)
+		}
+		sharers[inode] = append(sharers[inode], pid)
+	}
+	scanned, err := scanNetNSs(toScan, match)
+	found := make(map[int][]NetDev)
+	for _, pids := range sharers {
+		if netDevs, ok := scanned[pids[0]]; ok {
+			for _, pid := range pids {
+				found[pid] = netDevs
+			}
+		}
+	}
+	return found, err
+}
+
+// Call FindNetDevs for each process in parallel, returning the
+// non-empty results and the first error
+func scanNetNSs(processIDs []int, match func(netlink.Link) bool) (map[int][]NetDev, error) {
+	type result struct {
+		pid     int
+		netDevs []NetDev
+		err     error
+	}
+	jobs := make(chan int)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pid := range jobs {
+				netDevs, err := FindNetDevs(pid, match)
+				results <- result{pid, netDevs, err}
+			}
+		}()
+	}
+	go func() {
+		for _, pid := range processIDs {
+			jobs <- pid
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var err error
+	found := make(map[int][]NetDev)
+	for r := range results {
+		if r.err != nil {
+			if err == nil {
+				err = r.err
+			}
+			continue
+		}
+		if len(r.netDevs) > 0 {
+			found[r.pid] = r.netDevs
+		}
+	}
+	return found, err
+}
+
+// Map each network namespace, identified by its inode, to the first
+// process found in it
+func processesByNetNS() (map[string]int, error) {
+	proc, err := os.Open("/proc")
+	if err != nil {
+		return nil, err
+	}
+	defer proc.Close()
+	names, err := proc.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	pids := make(map[string]int)
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue // not a process
+		}
+		inode, err := netNSInode(pid)
+		if err != nil {
+			continue // process has gone away, or we can't see its namespace
+		}
+		if _, found := pids[inode]; !found {
+			pids[inode] = pid
+		}
+	}
+	return pids, nil
+}
+
+// The link target of /proc/<pid>/ns/net, which looks like "net:[<inode>]"
+func netNSInode(pid int) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/%d/ns/net", pid))
+}
+
+// Search the network namespace of a process for interfaces whose name
+// matches a pattern
+func FindNetDevsByPattern(processID int, namePattern *regexp.Regexp) ([]NetDev, error) {
+	return FindNetDevs(processID, func(link netlink.Link) bool {
+		return namePattern.MatchString(link.Attrs().Name)
+	})
+}
+
+// List all interfaces in the network namespace of a process
+func FindAllNetDevs(processID int) ([]NetDev, error) {
+	return FindNetDevs(processID, func(link netlink.Link) bool {
+		return true
+	})
+}
+
+// Predicate for FindNetDevs which matches interfaces having an address
+// inside the given subnet
+func MatchesCIDR(subnet *net.IPNet) func(netlink.Link) bool {
+	return matchAddrs(func(addr netlink.Addr) bool {
+		return subnet.Contains(addr.IP)
+	})
+}
+
+// Predicate for FindNetDevs which matches interfaces having the given address
+func MatchesIP(ip net.IP) func(netlink.Link) bool {
+	return matchAddrs(func(addr netlink.Addr) bool {
+		return addr.IP.Equal(ip)
+	})
+}
+
+// NB: FindNetDevs calls its predicate inside the target namespace, so
+// the address lookup here sees that namespace's addresses.
+func matchAddrs(check func(netlink.Addr) bool) func(netlink.Link) bool {
+	return func(link netlink.Link) bool {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			if check(addr) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Compare two sets of interfaces by name.  Interfaces present in both
+// but with a different MAC or addresses are returned as they are in curr.
+func DiffNetDevs(prev, curr []NetDev) (added, removed, changed []NetDev) {
+	prevByName := make(map[string]NetDev, len(prev))
+	for _, netDev := range prev {
+		prevByName[netDev.Name] = netDev
+	}
+	currNames := make(map[string]struct{}, len(curr))
+	for _, netDev := range curr {
+		currNames[netDev.Name] = struct{}{}
+		old, found := prevByName[netDev.Name]
+		switch {
+		case !found:
+			added = append(added, netDev)
+		case !bytes.Equal(old.MAC, netDev.MAC) || !sameCIDRs(old.CIDRs, netDev.CIDRs):
+			changed = append(changed, netDev)
+		}
+	}
+	for _, netDev := range prev {
+		if _, found := currNames[netDev.Name]; !found {
+			removed = append(removed, netDev)
+		}
+	}
+	return
+}
+
+// Compare as sets, since addresses needn't be listed in the same order
+func sameCIDRs(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, cidr := range a {
+		counts[cidr.String()]++
+	}
+	for _, cidr := range b {
+		if counts[cidr.String()] == 0 {
+			return false
+		}
+		counts[cidr.String()]--
+	}
+	return true
+}
+
+var ErrLinkNotFound = errors.New("link not found")
+
+// Find an interface in the current namespace by its MAC address, for
+// when its name may have been changed
+func LinkByMACAddr(mac net.HardwareAddr) (netlink.Link, error) {
+	// Otherwise we'd match the first link without one, e.g. a tun device
+	if len(mac) == 0 {
+		return nil, errors.New("no MAC address to look up")
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if bytes.Equal(link.Attrs().HardwareAddr, mac) {
+			return link, nil
+		}
+	}
+	return nil, ErrLinkNotFound
+}
+
 func forEachLink(f func(netlink.Link) error) error {
 	links, err := netlink.LinkList()
 	if err != nil {
@@ -82,30 +376,75 @@ func linkToNetDev(link netlink.Link) (*NetDev, error) {
 	}
 
 	netDev := &NetDev{Name: link.Attrs().Name, MAC: link.Attrs().HardwareAddr}
+	if stats := link.Attrs().Statistics; stats != nil {
+		netDev.RXBytes = uint64(stats.RxBytes)
+		netDev.TXBytes = uint64(stats.TxBytes)
+		netDev.RXErrors = uint64(stats.RxErrors)
+		netDev.TXErrors = uint64(stats.TxErrors)
+	}
 	for _, addr := range addrs {
 		netDev.CIDRs = append(netDev.CIDRs, addr.IPNet)
 	}
 	return netDev, nil
 }
 
+// Does link look like the named weave bridge, by name and type?  That
+// is a Linux bridge, or an Open vSwitch datapath when using fastdp.
+func IsWeaveInterface(link netlink.Link, bridgeName string) bool {
+	return link.Attrs().Name == bridgeName && (weavenet.IsBridge(link) || weavenet.IsDatapath(link))
+}
+
 // Lookup the weave interface of a container
 func GetWeaveNetDevs(processID int) ([]NetDev, error) {
+	return GetWeaveNetDevsForBridge(processID, weavenet.WeaveBridgeName)
+}
+
+var ErrTimeout = errors.New("timed out")
+
+// Like GetWeaveNetDevs, but give up after timeout.  The scan itself
+// cannot be interrupted, so on timeout it is left running in the
+// background and its result discarded.
+func GetWeaveNetDevsWithTimeout(processID int, timeout time.Duration) ([]NetDev, error) {
+	type result struct {
+		netDevs []NetDev
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		netDevs, err := GetWeaveNetDevs(processID)
+		done <- result{netDevs, err}
+	}()
+	select {
+	case r := <-done:
+		return r.netDevs, r.err
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Lookup the interfaces of a container that are attached to the named bridge
+func GetWeaveNetDevsForBridge(processID int, bridgeName string) ([]NetDev, error) {
 	// Bail out if this container is running in the root namespace
 	nsToplevel, err := netns.GetFromPid(1)
 	if err != nil {
 		return nil, fmt.Errorf("unable to open root namespace: %s", err)
 	}
+	defer nsToplevel.Close()
 	nsContainr, err := netns.GetFromPid(processID)
 	if err != nil {
 		return nil, fmt.Errorf("unable to open process %d namespace: %s", processID, err)
 	}
+	defer nsContainr.Close()
 	if nsToplevel.Equal(nsContainr) {
 		return nil, nil
 	}
 
-	weaveBridge, err := netlink.LinkByName("weave")
+	weaveBridge, err := netlink.LinkByName(bridgeName)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot find weave bridge: %s", err)
+		return nil, fmt.Errorf("Cannot find bridge %s: %s", bridgeName, err)
+	}
+	if !IsWeaveInterface(weaveBridge, bridgeName) {
+		return nil, fmt.Errorf("%s is a %s, not a weave bridge", bridgeName, weaveBridge.Type())
 	}
 	// Scan devices in root namespace to find those attached to weave bridge
 	indexes := make(map[int]struct{})
@@ -131,6 +470,161 @@ func GetWeaveNetDevs(processID int) ([]NetDev, error) {
 	})
 }
 
+// Send the weave interfaces of each process to ch as they are found,
+// closing ch when all processes have been scanned or stop is closed
+func StreamWeaveNetDevs(stop <-chan struct{}, processIDs []int, ch chan<- NetDev) error {
+	defer close(ch)
+	for _, pid := range processIDs {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		netDevs, err := GetWeaveNetDevs(pid)
+		if err != nil {
+			return err
+		}
+		for _, netDev := range netDevs {
+			select {
+			case ch <- netDev:
+			case <-stop:
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Assign an IP address to the interface of a container that is
+// attached to the named bridge
+func AssignContainerIP(pid int, bridgeName string, cidr *net.IPNet) error {
+	netDevs, err := GetWeaveNetDevsForBridge(pid, bridgeName)
+	if err != nil {
+		return err
+	}
+	if len(netDevs) == 0 {
+		return fmt.Errorf("no interface attached to %s in process %d namespace", bridgeName, pid)
+	}
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return fmt.Errorf("unable to open process %d namespace: %s", pid, err)
+	}
+	defer ns.Close()
+	return weavenet.WithNetNSLink(ns, netDevs[0].Name, func(link netlink.Link) error {
+		_, err := weavenet.AddAddresses(link, []*net.IPNet{cidr})
+		return err
+	})
+}
+
+// Connect a namespace created with 'ip netns add' to the named bridge,
+// giving it the addresses in cidrs, and return the new interface
+func AttachNamedNS(nsName, bridgeName string, cidrs []*net.IPNet) (NetDev, error) {
+	ns, err := netns.GetFromPath(fmt.Sprintf("/var/run/netns/%s", nsName))
+	if err != nil {
+		return NetDev{}, fmt.Errorf("unable to open namespace %s: %s", nsName, err)
+	}
+	defer ns.Close()
+	// AttachContainer names the veth pair after the start of the ID,
+	// which is unique for a container ID but not for a namespace name
+	h := fnv.New32a()
+	h.Write([]byte(nsName))
+	id := fmt.Sprintf("%08x", h.Sum32())
+	if err := weavenet.AttachContainer(ns, id, weavenet.VethName, bridgeName, 0, true, cidrs, false); err != nil {
+		return NetDev{}, err
+	}
+	var netDev NetDev
+	err = weavenet.WithNetNSLink(ns, weavenet.VethName, func(link netlink.Link) error {
+		found, err := linkToNetDev(link)
+		if err != nil {
+			return err
+		}
+		netDev = *found
+		return nil
+	})
+	return netDev, err
+}
+
+// Network setup of a container, gathered for diagnostics.  Fields are
+// kept as strings so that it reads well as JSON, e.g. in 'weave report'.
+type ContainerNetworkSummary struct {
+	PID     int
+	NetNS   string          // path to the container's network namespace
+	NetDevs []NetDevSummary // interfaces attached to the weave bridge
+	Routes  []RouteSummary
+}
+
+type NetDevSummary struct {
+	Name     string
+	MAC      string
+	CIDRs    []string
+	RXBytes  uint64
+	TXBytes  uint64
+	RXErrors uint64
+	TXErrors uint64
+}
+
+func summarizeNetDev(netDev NetDev) NetDevSummary {
+	summary := NetDevSummary{
+		Name:     netDev.Name,
+		MAC:      netDev.MAC.String(),
+		RXBytes:  netDev.RXBytes,
+		TXBytes:  netDev.TXBytes,
+		RXErrors: netDev.RXErrors,
+		TXErrors: netDev.TXErrors,
+	}
+	for _, cidr := range netDev.CIDRs {
+		summary.CIDRs = append(summary.CIDRs, cidr.String())
+	}
+	return summary
+}
+
+type RouteSummary struct {
+	Dest      string
+	Gateway   string
+	Interface string
+}
+
+func GetContainerNetworkSummary(pid int) (*ContainerNetworkSummary, error) {
+	netDevs, err := GetWeaveNetDevs(pid)
+	if err != nil {
+		return nil, err
+	}
+	summary := &ContainerNetworkSummary{
+		PID:   pid,
+		NetNS: fmt.Sprintf("/proc/%d/ns/net", pid),
+	}
+	for _, netDev := range netDevs {
+		summary.NetDevs = append(summary.NetDevs, summarizeNetDev(netDev))
+	}
+
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open process %d namespace: %s", pid, err)
+	}
+	defer ns.Close()
+	err = weavenet.WithNetNS(ns, func() error {
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, route := range routes {
+			r := RouteSummary{Dest: "default"}
+			if route.Dst != nil {
+				r.Dest = route.Dst.String()
+			}
+			if route.Gw != nil {
+				r.Gateway = route.Gw.String()
+			}
+			if link, err := netlink.LinkByIndex(route.LinkIndex); err == nil {
+				r.Interface = link.Attrs().Name
+			}
+			summary.Routes = append(summary.Routes, r)
+		}
+		return nil
+	})
+	return summary, err
+}
+
 // Get the weave bridge interface
 func GetBridgeNetDev(bridgeName string) ([]NetDev, error) {
 	return FindNetDevs(1, func(link netlink.Link) bool {
@@ -0,0 +1,318 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+const testBridgeName = "weavetestbr"
+
+// Start a process in a new network namespace, with one end of a veth
+// pair inside it and the other end attached to a test bridge.
+func setupTestNetNS(b testing.TB) (int, func()) {
+	if os.Getuid() != 0 {
+		b.Skip("creating network namespaces requires root")
+	}
+
+	cmd := exec.Command("sleep", "3600")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	require.NoError(b, cmd.Start())
+	pid := cmd.Process.Pid
+
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: testBridgeName}}
+	cleanup := func() {
+		// Don't leave the veth to the namespace's teardown, which the
+		// kernel does asynchronously, as the next test reuses its name
+		if veth, err := netlink.LinkByName("vethwetestpl"); err == nil {
+			netlink.LinkDel(veth)
+		}
+		netlink.LinkDel(bridge)
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	if err := netlink.LinkAdd(bridge); err != nil {
+		cleanup()
+		b.Fatal(err)
+	}
+	_, err := weavenet.CreateAndAttachVeth("vethwetestpl", "vethwetestpg", testBridgeName, 0, true, func(peer netlink.Link) error {
+		return netlink.LinkSetNsPid(peer, pid)
+	})
+	if err != nil {
+		cleanup()
+		b.Fatal(err)
+	}
+	return pid, cleanup
+}
+
+// Start another process in the network namespace of pid
+func joinTestNetNS(b testing.TB, pid int) (int, func()) {
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		b.Skip("joining a network namespace requires nsenter")
+	}
+	inode, err := netNSInode(pid)
+	require.NoError(b, err)
+
+	cmd := exec.Command("nsenter", fmt.Sprintf("--net=/proc/%d/ns/net", pid), "sleep", "3600")
+	require.NoError(b, cmd.Start())
+	cleanup := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	// nsenter only switches namespace once it is running
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if joined, err := netNSInode(cmd.Process.Pid); err == nil && joined == inode {
+			break
+		}
+		if time.Now().After(deadline) {
+			cleanup()
+			b.Fatal("process did not join the test namespace")
+		}
+	}
+	return cmd.Process.Pid, cleanup
+}
+
+func BenchmarkFindNetDevs(b *testing.B) {
+	pid, cleanup := setupTestNetNS(b)
+	defer cleanup()
+
+	match := func(link netlink.Link) bool {
+		_, isveth := link.(*netlink.Veth)
+		return isveth
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		netDevs, err := FindNetDevs(pid, match)
+		require.NoError(b, err)
+		require.Len(b, netDevs, 1)
+	}
+}
+
+func BenchmarkGetWeaveNetDevs(b *testing.B) {
+	pid, cleanup := setupTestNetNS(b)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		netDevs, err := GetWeaveNetDevsForBridge(pid, testBridgeName)
+		require.NoError(b, err)
+		require.Len(b, netDevs, 1)
+	}
+}
+
+func BenchmarkWithNetNS(b *testing.B) {
+	pid, cleanup := setupTestNetNS(b)
+	defer cleanup()
+	ns, err := netns.GetFromPid(pid)
+	require.NoError(b, err)
+	defer ns.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, weavenet.WithNetNS(ns, func() error { return nil }))
+	}
+}
+
+func TestIsWeaveInterface(t *testing.T) {
+	attrs := netlink.LinkAttrs{Name: "weave"}
+	require.True(t, IsWeaveInterface(&netlink.Bridge{LinkAttrs: attrs}, "weave"))
+	require.True(t, IsWeaveInterface(&netlink.GenericLink{LinkAttrs: attrs, LinkType: "openvswitch"}, "weave"))
+	require.True(t, IsWeaveInterface(&netlink.Device{LinkAttrs: attrs}, "weave"))
+	require.False(t, IsWeaveInterface(&netlink.Veth{LinkAttrs: attrs}, "weave"))
+	require.False(t, IsWeaveInterface(&netlink.Bridge{LinkAttrs: attrs}, "weavetestbr"))
+}
+
+func TestNetDevListFilters(t *testing.T) {
+	cidr := func(s string) *net.IPNet {
+		ip, ipnet, _ := net.ParseCIDR(s)
+		ipnet.IP = ip
+		return ipnet
+	}
+	ethwe := NetDev{Name: "ethwe", CIDRs: []*net.IPNet{cidr("10.32.0.1/12")}}
+	eth0 := NetDev{Name: "eth0", CIDRs: []*net.IPNet{cidr("172.17.0.2/16")}}
+	vethwepl := NetDev{Name: "vethwepl1234", CIDRs: []*net.IPNet{cidr("172.17.0.3/16"), cidr("10.32.0.2/12")}}
+	all := NetDevList{ethwe, eth0, vethwepl}
+
+	_, weaveSubnet, _ := net.ParseCIDR("10.32.0.0/12")
+	require.Equal(t, NetDevList{ethwe, vethwepl}, all.FilterByCIDR(weaveSubnet))
+	require.Equal(t, NetDevList{vethwepl}, all.FilterByName("veth*"))
+	require.Equal(t, NetDevList{ethwe, eth0}, all.FilterByName("eth*"))
+	require.Nil(t, all.FilterByName("["))
+}
+
+func TestDiffNetDevs(t *testing.T) {
+	mac := func(s string) net.HardwareAddr {
+		m, _ := net.ParseMAC(s)
+		return m
+	}
+	cidr := func(ss ...string) []*net.IPNet {
+		var result []*net.IPNet
+		for _, s := range ss {
+			ip, ipnet, _ := net.ParseCIDR(s)
+			ipnet.IP = ip
+			result = append(result, ipnet)
+		}
+		return result
+	}
+	eth0 := NetDev{Name: "ethwe", MAC: mac("12:34:56:78:9a:bc"), CIDRs: cidr("10.32.0.1/12")}
+	eth1 := NetDev{Name: "ethwe1", MAC: mac("12:34:56:78:9a:bd"), CIDRs: cidr("10.32.0.2/12")}
+	eth2 := NetDev{Name: "ethwe2", MAC: mac("12:34:56:78:9a:be")}
+	eth1Readdressed := eth1
+	eth1Readdressed.CIDRs = cidr("10.40.0.2/12")
+
+	added, removed, changed := DiffNetDevs([]NetDev{eth0, eth1}, []NetDev{eth0, eth1Readdressed, eth2})
+	require.Equal(t, []NetDev{eth2}, added)
+	require.Nil(t, removed)
+	require.Equal(t, []NetDev{eth1Readdressed}, changed)
+
+	added, removed, changed = DiffNetDevs([]NetDev{eth0, eth1}, []NetDev{eth1})
+	require.Nil(t, added)
+	require.Equal(t, []NetDev{eth0}, removed)
+	require.Nil(t, changed)
+
+	// The same addresses listed in a different order are not a change
+	eth3 := NetDev{Name: "ethwe3", MAC: mac("12:34:56:78:9a:bf"), CIDRs: cidr("10.32.0.3/12", "10.40.0.3/12")}
+	eth3Reordered := eth3
+	eth3Reordered.CIDRs = cidr("10.40.0.3/12", "10.32.0.3/12")
+	added, removed, changed = DiffNetDevs([]NetDev{eth3}, []NetDev{eth3Reordered})
+	require.Nil(t, added)
+	require.Nil(t, removed)
+	require.Nil(t, changed)
+}
+
+func TestFindNetDevsAllContainers(t *testing.T) {
+	pid, cleanup := setupTestNetNS(t)
+	defer cleanup()
+	pid2, cleanup2 := joinTestNetNS(t, pid)
+	defer cleanup2()
+
+	found, err := FindNetDevsAllContainers(func(link netlink.Link) bool {
+		return link.Attrs().Name == "vethwetestpg"
+	})
+	require.NoError(t, err)
+	// The shared namespace is reported once, against one of its processes
+	var reportedAgainst []int
+	for p, netDevs := range found {
+		for _, netDev := range netDevs {
+			if netDev.Name == "vethwetestpg" {
+				reportedAgainst = append(reportedAgainst, p)
+			}
+		}
+	}
+	require.Len(t, reportedAgainst, 1)
+	require.Contains(t, []int{pid, pid2}, reportedAgainst[0])
+}
+
+func TestFindNetDevsForPIDs(t *testing.T) {
+	pid, cleanup := setupTestNetNS(t)
+	defer cleanup()
+	pid2, cleanup2 := joinTestNetNS(t, pid)
+	defer cleanup2()
+
+	scans := 0 // every scan of the namespace visits its loopback once
+	found, err := FindNetDevsForPIDs([]int{pid, pid2}, func(link netlink.Link) bool {
+		if link.Attrs().Name == "lo" {
+			scans++
+		}
+		return link.Attrs().Name == "vethwetestpg"
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, scans)
+	require.Len(t, found, 2)
+	require.Len(t, found[pid], 1)
+	require.Equal(t, "vethwetestpg", found[pid][0].Name)
+	require.Equal(t, found[pid], found[pid2])
+}
+
+func TestAttachNamedNS(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("creating network namespaces requires root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("creating named network namespaces requires ip")
+	}
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: testBridgeName}}
+	require.NoError(t, netlink.LinkAdd(bridge))
+	defer func() {
+		// Remove the host ends of the veths along with the bridge
+		if links, err := netlink.LinkList(); err == nil {
+			for _, link := range links {
+				if link.Attrs().MasterIndex == bridge.Attrs().Index {
+					netlink.LinkDel(link)
+				}
+			}
+		}
+		netlink.LinkDel(bridge)
+	}()
+
+	// Names sharing a long prefix still get distinct interfaces
+	for i, nsName := range []string{"weavetest-a", "weavetest-b"} {
+		require.NoError(t, exec.Command("ip", "netns", "add", nsName).Run())
+		defer exec.Command("ip", "netns", "del", nsName).Run()
+		ip, cidr, _ := net.ParseCIDR(fmt.Sprintf("10.32.0.%d/12", i+1))
+		cidr.IP = ip
+		netDev, err := AttachNamedNS(nsName, testBridgeName, []*net.IPNet{cidr})
+		require.NoError(t, err, nsName)
+		require.Equal(t, weavenet.VethName, netDev.Name)
+	}
+}
+
+func TestContainerNetworkSummaryJSON(t *testing.T) {
+	mac, _ := net.ParseMAC("12:34:56:78:9a:bc")
+	ip, cidr, _ := net.ParseCIDR("10.32.0.1/12")
+	cidr.IP = ip
+	summary := ContainerNetworkSummary{
+		PID:     1234,
+		NetNS:   "/proc/1234/ns/net",
+		NetDevs: []NetDevSummary{summarizeNetDev(NetDev{Name: "ethwe", MAC: mac, CIDRs: []*net.IPNet{cidr}, RXBytes: 42})},
+		Routes:  []RouteSummary{{Dest: "default", Gateway: "10.32.0.254", Interface: "ethwe"}},
+	}
+	data, err := json.Marshal(summary)
+	require.NoError(t, err)
+
+	var decoded struct {
+		NetDevs []map[string]interface{}
+	}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Len(t, decoded.NetDevs, 1)
+	require.Equal(t, "12:34:56:78:9a:bc", decoded.NetDevs[0]["MAC"])
+	require.Equal(t, []interface{}{"10.32.0.1/12"}, decoded.NetDevs[0]["CIDRs"])
+	require.Equal(t, float64(42), decoded.NetDevs[0]["RXBytes"])
+}
+
+func TestLinkByMACAddrEmpty(t *testing.T) {
+	_, err := LinkByMACAddr(nil)
+	require.Error(t, err)
+	_, err = LinkByMACAddr(net.HardwareAddr{})
+	require.Error(t, err)
+}
+
+func TestFindNetDevsByPattern(t *testing.T) {
+	pid, cleanup := setupTestNetNS(t)
+	defer cleanup()
+
+	netDevs, err := FindNetDevsByPattern(pid, regexp.MustCompile("^veth"))
+	require.NoError(t, err)
+	require.Len(t, netDevs, 1)
+	require.Equal(t, "vethwetestpg", netDevs[0].Name)
+
+	netDevs, err = FindNetDevsByPattern(pid, regexp.MustCompile("^lo$"))
+	require.NoError(t, err)
+	require.Len(t, netDevs, 1)
+
+	netDevs, err = FindNetDevsByPattern(pid, regexp.MustCompile("^ethwe"))
+	require.NoError(t, err)
+	require.Empty(t, netDevs)
+}
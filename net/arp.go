@@ -2,7 +2,9 @@ package net
 
 import "fmt"
 import "io"
+import "io/ioutil"
 import "os"
+import "strings"
 
 // Configure the ARP cache parameters for the given interface.  This
 // makes containers react more quickly to a change in the MAC address
@@ -21,7 +23,12 @@ func ConfigureARPCache(name string) error {
 }
 
 func sysctl(variable, value string) error {
-	f, err := os.OpenFile(fmt.Sprintf("/proc/sys/%s", variable), os.O_WRONLY, 0)
+	return writeFile(fmt.Sprintf("/proc/sys/%s", variable), value)
+}
+
+// Write value to an existing file, e.g. under /proc or /sys
+func writeFile(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
 	if err != nil {
 		return err
 	}
@@ -41,3 +48,11 @@ func sysctl(variable, value string) error {
 
 	return nil
 }
+
+func readSysctl(variable string) (string, error) {
+	value, err := ioutil.ReadFile(fmt.Sprintf("/proc/sys/%s", variable))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
@@ -1,6 +1,10 @@
 package net
 
 import (
+	"fmt"
+	"net"
+	"strings"
+
 	"github.com/vishvananda/netlink"
 )
 
@@ -24,23 +28,46 @@ func DetectBridgeType(weaveBridgeName, datapathName string) BridgeType {
 	switch {
 	case bridge == nil && datapath == nil:
 		return None
-	case isBridge(bridge) && datapath == nil:
+	case IsBridge(bridge) && datapath == nil:
 		return Bridge
-	case isDatapath(bridge) && datapath == nil:
+	case IsDatapath(bridge) && datapath == nil:
 		return Fastdp
-	case isDatapath(datapath) && isBridge(bridge):
+	case IsDatapath(datapath) && IsBridge(bridge):
 		return BridgedFastdp
 	default:
 		return Inconsistent
 	}
 }
 
-func isBridge(link netlink.Link) bool {
+// Cheaper than DetectBridgeType when all that matters is whether
+// anything called bridgeName is there
+func BridgeExists(bridgeName string) (bool, error) {
+	_, err := netlink.LinkByName(bridgeName)
+	switch {
+	case err == nil:
+		return true, nil
+	case isLinkNotFound(err):
+		return false, nil
+	default:
+		return false, fmt.Errorf(`unable to look up bridge "%s": %s`, bridgeName, err)
+	}
+}
+
+// netlink doesn't pass on ENODEV for a missing link, but reports it as
+// "Link not found" or "Link <name> not found"
+func isLinkNotFound(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "Link ") && strings.HasSuffix(msg, " not found")
+}
+
+// Is link a Linux bridge?
+func IsBridge(link netlink.Link) bool {
 	_, isBridge := link.(*netlink.Bridge)
 	return isBridge
 }
 
-func isDatapath(link netlink.Link) bool {
+// Is link an Open vSwitch datapath?
+func IsDatapath(link netlink.Link) bool {
 	switch link.(type) {
 	case *netlink.GenericLink:
 		return link.Type() == "openvswitch"
@@ -51,3 +78,106 @@ func isDatapath(link netlink.Link) bool {
 		return false
 	}
 }
+
+// In bridged fastdp mode, packets larger than the smaller of the bridge
+// and datapath MTUs are dropped, so the two must agree.  Other bridge
+// types have nothing to compare and are always consistent.
+func CheckMTUConsistency(bridgeName, datapathName string) (consistent bool, bridgeMTU, datapathMTU int, err error) {
+	if DetectBridgeType(bridgeName, datapathName) != BridgedFastdp {
+		return true, 0, 0, nil
+	}
+	bridge, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return false, 0, 0, fmt.Errorf(`bridge "%s" not present: %s`, bridgeName, err)
+	}
+	datapath, err := netlink.LinkByName(datapathName)
+	if err != nil {
+		return false, 0, 0, fmt.Errorf(`datapath "%s" not present: %s`, datapathName, err)
+	}
+	bridgeMTU, datapathMTU = bridge.Attrs().MTU, datapath.Attrs().MTU
+	return bridgeMTU == datapathMTU, bridgeMTU, datapathMTU, nil
+}
+
+// An interface attached to the weave bridge
+type BridgePort struct {
+	Name  string
+	Index int
+	MAC   net.HardwareAddr
+}
+
+// A Linux bridge, as used in Bridge and BridgedFastdp modes.  Ports of
+// a fastdp datapath are vports, managed through the odp package.
+type Weavebridge struct {
+	Name string
+}
+
+func (b Weavebridge) bridge() (netlink.Link, error) {
+	bridge, err := netlink.LinkByName(b.Name)
+	if err != nil {
+		return nil, fmt.Errorf(`bridge "%s" not present: %s`, b.Name, err)
+	}
+	if !IsBridge(bridge) {
+		return nil, fmt.Errorf(`"%s" is not a bridge`, b.Name)
+	}
+	return bridge, nil
+}
+
+func (b Weavebridge) Attach(portName string) (*BridgePort, error) {
+	bridge, err := b.bridge()
+	if err != nil {
+		return nil, err
+	}
+	port, err := netlink.LinkByName(portName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find port %s: %s", portName, err)
+	}
+	if err := netlink.LinkSetMasterByIndex(port, bridge.Attrs().Index); err != nil {
+		return nil, fmt.Errorf(`unable to attach %s to bridge "%s": %s`, portName, b.Name, err)
+	}
+	return linkToBridgePort(port), nil
+}
+
+func (b Weavebridge) Detach(portName string) error {
+	return DetachBridgePort(b.Name, portName)
+}
+
+func (b Weavebridge) ListPorts() ([]BridgePort, error) {
+	bridge, err := b.bridge()
+	if err != nil {
+		return nil, err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var ports []BridgePort
+	for _, link := range links {
+		if link.Attrs().MasterIndex == bridge.Attrs().Index {
+			ports = append(ports, *linkToBridgePort(link))
+		}
+	}
+	return ports, nil
+}
+
+func linkToBridgePort(link netlink.Link) *BridgePort {
+	return &BridgePort{Name: link.Attrs().Name, Index: link.Attrs().Index, MAC: link.Attrs().HardwareAddr}
+}
+
+// Detach a single port from the weave bridge, leaving the port itself in place
+func DetachBridgePort(bridgeName, portName string) error {
+	bridge, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return fmt.Errorf(`bridge "%s" not present: %s`, bridgeName, err)
+	}
+	port, err := netlink.LinkByName(portName)
+	if err != nil {
+		return fmt.Errorf("unable to find port %s: %s", portName, err)
+	}
+	if port.Attrs().MasterIndex != bridge.Attrs().Index {
+		return fmt.Errorf(`%s is not attached to bridge "%s"`, portName, bridgeName)
+	}
+	if err := netlink.LinkSetNoMaster(port); err != nil {
+		return fmt.Errorf(`unable to detach %s from bridge "%s": %s`, portName, bridgeName, err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBridgeExists(t *testing.T) {
+	exists, err := BridgeExists("weavenosuchbr")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// Any kind of link counts
+	exists, err = BridgeExists("lo")
+	require.NoError(t, err)
+	require.True(t, exists)
+}
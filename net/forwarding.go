@@ -0,0 +1,18 @@
+package net
+
+const ipv6ForwardingSysctl = "net/ipv6/conf/all/forwarding"
+
+// Report whether the kernel is forwarding IPv6 packets between
+// interfaces.  Returns an error if the kernel has no IPv6 support.
+func ProbeIPv6Forwarding() (bool, error) {
+	value, err := readSysctl(ipv6ForwardingSysctl)
+	if err != nil {
+		return false, err
+	}
+	return value == "1", nil
+}
+
+// Turn on kernel forwarding of IPv6 packets between interfaces.
+func EnableIPv6Forwarding() error {
+	return sysctl(ipv6ForwardingSysctl, "1")
+}
@@ -0,0 +1,80 @@
+package net
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+)
+
+// A panic in work must still unlock the thread and switch it back to
+// the original namespace, since WithNetNS does both in deferred calls.
+func TestWithNetNSPanic(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("switching network namespaces requires root")
+	}
+
+	cmd := exec.Command("sleep", "3600")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	require.NoError(t, cmd.Start())
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	target, err := netns.GetFromPid(cmd.Process.Pid)
+	require.NoError(t, err)
+	defer target.Close()
+	original, err := netns.Get()
+	require.NoError(t, err)
+	defer original.Close()
+
+	baseline := runtime.NumGoroutine()
+	errs := make(chan error, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Hold on to this thread across WithNetNS, so the check
+			// below looks at the thread that ran work
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			defer func() {
+				if recover() == nil {
+					errs <- fmt.Errorf("work did not panic")
+					return
+				}
+				current, err := netns.Get()
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer current.Close()
+				if !current.Equal(original) {
+					errs <- fmt.Errorf("thread left in namespace %s", current)
+				}
+			}()
+			WithNetNS(target, func() error {
+				panic("work failed")
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Goroutines may take a moment to finish exiting after Done
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > baseline && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, runtime.NumGoroutine() <= baseline, "goroutines leaked")
+}
@@ -0,0 +1,28 @@
+package net
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Bridge timers in sysfs are in hundredths of a second
+const sysfsTicksPerSecond = 100
+
+func setBridgeTimerSysfs(bridgeName, timer string, seconds int) error {
+	path := fmt.Sprintf("/sys/class/net/%s/bridge/%s", bridgeName, timer)
+	if err := writeFile(path, strconv.Itoa(seconds*sysfsTicksPerSecond)); err != nil {
+		return fmt.Errorf(`unable to set %s of bridge "%s": %s`, timer, bridgeName, err)
+	}
+	return nil
+}
+
+// Set how long the bridge remembers a MAC address, via sysfs, for
+// kernels which don't support setting it via netlink
+func SetBridgeAgeTimeSysfs(bridgeName string, seconds int) error {
+	return setBridgeTimerSysfs(bridgeName, "ageing_time", seconds)
+}
+
+// Set the bridge's STP forward delay, via sysfs
+func SetBridgeForwardDelaySysfs(bridgeName string, seconds int) error {
+	return setBridgeTimerSysfs(bridgeName, "forward_delay", seconds)
+}
@@ -3,6 +3,7 @@ package net
 import (
 	"fmt"
 	"net"
+	"syscall"
 	"time"
 
 	"github.com/j-keck/arping"
@@ -72,6 +73,35 @@ func CreateAndAttachVeth(name, peerName, bridgeName string, mtu int, keepTXOn bo
 	return veth, nil
 }
 
+// Delete a veth pair, given the name of one end.  The kernel removes
+// both ends when either is deleted, so an end that has already gone
+// (ENODEV) is not treated as an error.
+func TeardownVethPair(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("unable to find veth %s: %s", name, err)
+	}
+	veth, ok := link.(*netlink.Veth)
+	if !ok {
+		return fmt.Errorf("%s is a %s, not a veth", name, link.Type())
+	}
+	// ParentIndex is the peer's index in its own namespace, which may
+	// not be ours; only trust a match that points back at us.
+	if peerIndex := veth.Attrs().ParentIndex; peerIndex != 0 {
+		if peer, err := netlink.LinkByIndex(peerIndex); err == nil {
+			if _, isVeth := peer.(*netlink.Veth); isVeth && peer.Attrs().ParentIndex == veth.Attrs().Index {
+				if err := netlink.LinkDel(peer); err != nil && err != syscall.ENODEV {
+					return fmt.Errorf("unable to delete veth %s: %s", peer.Attrs().Name, err)
+				}
+			}
+		}
+	}
+	if err := netlink.LinkDel(veth); err != nil && err != syscall.ENODEV {
+		return fmt.Errorf("unable to delete veth %s: %s", name, err)
+	}
+	return nil
+}
+
 func AddAddresses(link netlink.Link, cidrs []*net.IPNet) (newAddrs []*net.IPNet, err error) {
 	existingAddrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
 	if err != nil {
@@ -9,7 +9,6 @@ import (
 	"github.com/docker/libnetwork/netlabel"
 	"github.com/docker/libnetwork/types"
 
-	"github.com/vishvananda/netlink"
 	weaveapi "github.com/weaveworks/weave/api"
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/common/docker"
@@ -26,6 +25,7 @@ type network struct {
 }
 
 type driver struct {
+	name   string // as Docker knows us, e.g. in a network's Driver field
 	scope  string
 	docker *docker.Client
 	sync.RWMutex
@@ -33,15 +33,16 @@ type driver struct {
 	networks  map[string]network
 }
 
-func New(client *docker.Client, weave *weaveapi.Client, scope string) (skel.Driver, error) {
+func New(client *docker.Client, weave *weaveapi.Client, name, scope string, opts ...WatcherOption) (skel.Driver, error) {
 	driver := &driver{
+		name:      name,
 		scope:     scope,
 		docker:    client,
 		endpoints: make(map[string]struct{}),
 		networks:  make(map[string]network),
 	}
 
-	_, err := NewWatcher(client, weave, driver)
+	_, err := NewWatcher(client, weave, driver, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -199,9 +200,8 @@ func (driver *driver) LeaveEndpoint(leave *api.LeaveRequest) error {
 	driver.logReq("LeaveEndpoint", leave, fmt.Sprintf("%s:%s", leave.NetworkID, leave.EndpointID))
 
 	name, _ := vethPair(leave.EndpointID)
-	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}}
-	if err := netlink.LinkDel(veth); err != nil {
-		driver.warn("LeaveEndpoint", "unable to delete veth: %s", err)
+	if err := weavenet.TeardownVethPair(name); err != nil {
+		driver.warn("LeaveEndpoint", "%s", err)
 	}
 	return nil
 }
@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"sync"
+
+	"github.com/weaveworks/weave/db"
+)
+
+// Persistence for the watcher's record of DNS-registered containers
+type RegistrationStore interface {
+	Put(id string, r RegisteredContainer) error
+	Get(id string) (RegisteredContainer, bool, error)
+	Delete(id string) error
+	List() ([]RegisteredContainer, error)
+}
+
+type memoryRegistrationStore struct {
+	sync.Mutex
+	registered map[string]RegisteredContainer
+}
+
+// NewMemoryRegistrationStore returns a store which is lost when the
+// process exits
+func NewMemoryRegistrationStore() RegistrationStore {
+	return &memoryRegistrationStore{registered: make(map[string]RegisteredContainer)}
+}
+
+func (s *memoryRegistrationStore) Put(id string, r RegisteredContainer) error {
+	s.Lock()
+	s.registered[id] = r
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryRegistrationStore) Get(id string) (RegisteredContainer, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, found := s.registered[id]
+	return r, found, nil
+}
+
+func (s *memoryRegistrationStore) Delete(id string) error {
+	s.Lock()
+	delete(s.registered, id)
+	s.Unlock()
+	return nil
+}
+
+func (s *memoryRegistrationStore) List() ([]RegisteredContainer, error) {
+	s.Lock()
+	defer s.Unlock()
+	result := make([]RegisteredContainer, 0, len(s.registered))
+	for _, r := range s.registered {
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// Keeps the whole set in memory, and writes it out to the db on every change
+type dbRegistrationStore struct {
+	sync.Mutex
+	db         db.DB
+	ident      string
+	registered map[string]RegisteredContainer
+}
+
+// NewDBRegistrationStore returns a store kept in db under ident, loading
+// any registrations saved there by a previous run
+func NewDBRegistrationStore(d db.DB, ident string) (RegistrationStore, error) {
+	s := &dbRegistrationStore{db: d, ident: ident}
+	if _, err := d.Load(ident, &s.registered); err != nil {
+		return nil, err
+	}
+	if s.registered == nil {
+		s.registered = make(map[string]RegisteredContainer)
+	}
+	return s, nil
+}
+
+func (s *dbRegistrationStore) Put(id string, r RegisteredContainer) error {
+	s.Lock()
+	defer s.Unlock()
+	s.registered[id] = r
+	return s.db.Save(s.ident, s.registered)
+}
+
+func (s *dbRegistrationStore) Get(id string) (RegisteredContainer, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, found := s.registered[id]
+	return r, found, nil
+}
+
+func (s *dbRegistrationStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.registered[id]; !found {
+		return nil
+	}
+	delete(s.registered, id)
+	return s.db.Save(s.ident, s.registered)
+}
+
+func (s *dbRegistrationStore) List() ([]RegisteredContainer, error) {
+	s.Lock()
+	defer s.Unlock()
+	result := make([]RegisteredContainer, 0, len(s.registered))
+	for _, r := range s.registered {
+		result = append(result, r)
+	}
+	return result, nil
+}
@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBRegistrationStore(t *testing.T) {
+	d := newMockDB()
+	store, err := NewDBRegistrationStore(d, "dnsregistrations")
+	require.NoError(t, err)
+	r1 := RegisteredContainer{ContainerID: "c1", FQDN: "db.weave.local", Aliases: []string{"pg.weave.local"}, IPs: []net.IP{net.ParseIP("10.32.0.1")}}
+	r2 := RegisteredContainer{ContainerID: "c2", FQDN: "web.weave.local", IPs: []net.IP{net.ParseIP("10.32.0.2")}}
+	require.NoError(t, store.Put("c1", r1))
+	require.NoError(t, store.Put("c2", r2))
+	require.NoError(t, store.Delete("c2"))
+	require.NoError(t, store.Delete("nonexistent"))
+
+	// A new store on the same db sees what the old one saved
+	store, err = NewDBRegistrationStore(d, "dnsregistrations")
+	require.NoError(t, err)
+	r, found, err := store.Get("c1")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, r1.FQDN, r.FQDN)
+	require.Equal(t, r1.Aliases, r.Aliases)
+	require.True(t, r1.IPs[0].Equal(r.IPs[0]))
+	_, found, err = store.Get("c2")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// Stores under other idents are kept apart
+	other, err := NewDBRegistrationStore(d, "dnsregistrations-other")
+	require.NoError(t, err)
+	_, found, err = other.Get("c1")
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestWatcherReconcilesStore(t *testing.T) {
+	dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+	store := NewMemoryRegistrationStore()
+	// c1 was registered, and is still running; c2 stopped while we were
+	// down; c3 died and was restarted, so weaveDNS no longer has its name
+	dockerClient.addContainer("c1", "db", "", map[string]string{"ep1": "10.32.0.1"})
+	dockerClient.addContainer("c3", "cache", "", map[string]string{"ep1": "10.32.0.3"})
+	r1 := RegisteredContainer{ContainerID: "c1", FQDN: "db.weave.local", StartedAt: testStartedAt}
+	require.NoError(t, store.Put("c1", r1))
+	require.NoError(t, store.Put("c2", RegisteredContainer{ContainerID: "c2", FQDN: "web.weave.local", StartedAt: testStartedAt}))
+	require.NoError(t, store.Put("c3", RegisteredContainer{ContainerID: "c3", FQDN: "cache.weave.local", StartedAt: testStartedAt}))
+	dockerClient.restartContainer("c3")
+
+	w, err := newWatcher(dockerClient, weave, newTestDriver("ep1"), WithDomain(WeaveDomain), WithRegistrationStore(store))
+	require.NoError(t, err)
+	w.registerExisting()
+	// c1 is not registered a second time
+	require.Empty(t, weave.lookup("db.weave.local"))
+	r, found, err := store.Get("c1")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, r1, r)
+	_, found, err = store.Get("c2")
+	require.NoError(t, err)
+	require.False(t, found)
+	// c3 is registered again for its new run
+	require.Equal(t, []string{"c3 10.32.0.3"}, weave.lookup("cache.weave.local"))
+	require.Len(t, w.ListRegisteredContainers(), 2)
+}
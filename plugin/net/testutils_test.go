@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	weavedocker "github.com/weaveworks/weave/common/docker"
+)
+
+// In-memory stand-in for the Docker client
+type mockDockerClient struct {
+	sync.Mutex
+	containers map[string]*docker.Container
+	networks   map[string]*docker.Network
+	observers  []weavedocker.ContainerObserver
+	inspected  int
+}
+
+func newMockDockerClient() *mockDockerClient {
+	return &mockDockerClient{containers: make(map[string]*docker.Container), networks: make(map[string]*docker.Network)}
+}
+
+// When every mock container started, unless restarted since
+var testStartedAt = time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// Add a network run by the named driver
+func (c *mockDockerClient) addNetwork(id, driver string) {
+	c.Lock()
+	c.networks[id] = &docker.Network{ID: id, Driver: driver}
+	c.Unlock()
+}
+
+// Add a container attached to the given endpoints, mapped to their IP
+// addresses.  Each endpoint is on its own network, "net-<endpointID>",
+// where the container has the given network aliases.
+func (c *mockDockerClient) addContainer(id, hostname, domainname string, endpoints map[string]string, aliases ...string) {
+	networks := make(map[string]docker.ContainerNetwork)
+	for endpointID, ip := range endpoints {
+		networks["net-"+endpointID] = docker.ContainerNetwork{EndpointID: endpointID, NetworkID: "net-" + endpointID, IPAddress: ip, Aliases: aliases}
+	}
+	c.Lock()
+	c.containers[id] = &docker.Container{
+		ID:              id,
+		Config:          &docker.Config{Hostname: hostname, Domainname: domainname},
+		State:           docker.State{Running: true, StartedAt: testStartedAt},
+		NetworkSettings: &docker.NetworkSettings{Networks: networks},
+	}
+	c.Unlock()
+}
+
+// Give the container a new start time, as if it died and was started again
+func (c *mockDockerClient) restartContainer(id string) {
+	c.Lock()
+	c.containers[id].State.StartedAt = c.containers[id].State.StartedAt.Add(time.Minute)
+	c.Unlock()
+}
+
+func (c *mockDockerClient) AddObserver(ob weavedocker.ContainerObserver) error {
+	c.Lock()
+	c.observers = append(c.observers, ob)
+	c.Unlock()
+	return nil
+}
+
+func (c *mockDockerClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	c.Lock()
+	defer c.Unlock()
+	var result []docker.APIContainers
+	for id := range c.containers {
+		result = append(result, docker.APIContainers{ID: id})
+	}
+	return result, nil
+}
+
+func (c *mockDockerClient) InspectContainer(id string) (*docker.Container, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.inspected++
+	container, found := c.containers[id]
+	if !found {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	return container, nil
+}
+
+func (c *mockDockerClient) NetworkInfo(id string) (*docker.Network, error) {
+	c.Lock()
+	defer c.Unlock()
+	network, found := c.networks[id]
+	if !found {
+		return nil, &docker.NoSuchNetwork{ID: id}
+	}
+	return network, nil
+}
+
+var errWeaveDown = errors.New("dial tcp 127.0.0.1:6784: connection refused")
+
+// In-memory stand-in for the weave API client's DNS registration
+type mockWeaveClient struct {
+	sync.Mutex
+	names map[string][]string // fqdn -> "containerID ip"
+	err   error               // returned from every call when set
+	errIP string              // if set, err is only returned for this IP
+}
+
+func newMockWeaveClient() *mockWeaveClient {
+	return &mockWeaveClient{names: make(map[string][]string)}
+}
+
+func (c *mockWeaveClient) RegisterWithDNS(ID string, fqdn string, ip string) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil && (c.errIP == "" || c.errIP == ip) {
+		return c.err
+	}
+	c.names[fqdn] = append(c.names[fqdn], fmt.Sprintf("%s %s", ID, ip))
+	return nil
+}
+
+func (c *mockWeaveClient) lookup(fqdn string) []string {
+	c.Lock()
+	defer c.Unlock()
+	return c.names[fqdn]
+}
+
+// A driver named "weave" which owns the given endpoints
+func newTestDriver(endpointIDs ...string) *driver {
+	d := &driver{name: "weave", endpoints: make(map[string]struct{}), networks: make(map[string]network)}
+	for _, id := range endpointIDs {
+		d.endpoints[id] = struct{}{}
+	}
+	return d
+}
+
+// db.DB which gob-encodes into memory, like BoltDB does on disk
+type mockDB struct {
+	sync.Mutex
+	data map[string][]byte
+}
+
+func newMockDB() *mockDB {
+	return &mockDB{data: make(map[string][]byte)}
+}
+
+func (d *mockDB) Load(ident string, data interface{}) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	v, found := d.data[ident]
+	if !found {
+		return false, nil
+	}
+	return true, gob.NewDecoder(bytes.NewReader(v)).Decode(data)
+}
+
+func (d *mockDB) Save(ident string, data interface{}) error {
+	d.Lock()
+	defer d.Unlock()
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(data); err != nil {
+		return err
+	}
+	d.data[ident] = buf.Bytes()
+	return nil
+}
@@ -2,27 +2,204 @@ package plugin
 
 import (
 	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
+	docker "github.com/fsouza/go-dockerclient"
 	weaveapi "github.com/weaveworks/weave/api"
-	"github.com/weaveworks/weave/common/docker"
+	weavedocker "github.com/weaveworks/weave/common/docker"
 )
 
 const (
 	WeaveDomain = "weave.local"
 )
 
+// The parts of the Docker client used by the watcher
+type dockerClient interface {
+	AddObserver(ob weavedocker.ContainerObserver) error
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	InspectContainer(id string) (*docker.Container, error)
+	NetworkInfo(id string) (*docker.Network, error)
+}
+
+// The parts of the weave API client used by the watcher
+type dnsRegistrar interface {
+	RegisterWithDNS(ID string, fqdn string, ip string) error
+}
+
 type watcher struct {
-	client *docker.Client
-	weave  *weaveapi.Client
+	client dockerClient
+	weave  dnsRegistrar
 	driver *driver
+	domain string
+	store  RegistrationStore
+	// registrations of existing containers are spread over this long
+	startupJitter time.Duration
+	sync.Mutex
+	pending  map[string]time.Time // start time of each run being registered right now
+	networks map[string]bool      // network ID -> whether it uses our driver
 }
 
 type Watcher interface {
+	RegisterAllExisting(since time.Time) error
+	ListRegisteredContainers() []RegisteredContainer
+}
+
+// A container the watcher has registered with weaveDNS
+type RegisteredContainer struct {
+	ContainerID string
+	FQDN        string
+	Aliases     []string // additional names from Docker network aliases
+	IPs         []net.IP
+	StartedAt   time.Time // tells a restart apart from the run we registered
+}
+
+// WatcherOption configures optional behaviour of a Watcher
+type WatcherOption func(*watcher)
+
+// WithDomain sets the domain used to register containers that have no
+// domain name of their own
+func WithDomain(domain string) WatcherOption {
+	return func(w *watcher) {
+		w.domain = domain
+	}
+}
+
+// WithRegistrationStore keeps the record of registered containers in
+// store instead of in memory
+func WithRegistrationStore(store RegistrationStore) WatcherOption {
+	return func(w *watcher) {
+		w.store = store
+	}
+}
+
+// WithStartupJitter delays registering each container found running at
+// startup by a random fraction of jitter, so that many plugins starting
+// at once don't all hit weaveDNS together
+func WithStartupJitter(jitter time.Duration) WatcherOption {
+	return func(w *watcher) {
+		w.startupJitter = jitter
+	}
+}
+
+func NewWatcher(client *weavedocker.Client, weave *weaveapi.Client, driver *driver, opts ...WatcherOption) (Watcher, error) {
+	w, err := newWatcher(client, weave, driver, opts...)
+	if err != nil {
+		return nil, err // don't return a nil *watcher as a non-nil Watcher
+	}
+	// In the background, since Docker may be waiting on the plugin to
+	// start a container, and holds that container's lock meanwhile
+	go w.registerExisting()
+	return w, nil
+}
+
+func newWatcher(client dockerClient, weave dnsRegistrar, driver *driver, opts ...WatcherOption) (*watcher, error) {
+	w := &watcher{client: client, weave: weave, driver: driver, store: NewMemoryRegistrationStore(),
+		pending: make(map[string]time.Time), networks: make(map[string]bool)}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.domain != "" {
+		if err := ValidateDomain(w.domain); err != nil {
+			return nil, err
+		}
+	}
+	if err := client.AddObserver(w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Catch up with containers started before we were listening, which
+// won't produce events
+func (w *watcher) registerExisting() {
+	if err := w.reconcile(); err != nil {
+		w.driver.warn("NewWatcher", "unable to check stored registrations: %s", err)
+	}
+	if w.startupJitter <= 0 {
+		if err := w.RegisterAllExisting(time.Time{}); err != nil {
+			w.driver.warn("NewWatcher", "unable to register existing containers: %s", err)
+		}
+		return
+	}
+	containers, err := w.client.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		w.driver.warn("NewWatcher", "unable to register existing containers: %s", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, c := range containers {
+		wg.Add(1)
+		go func(id string, delay time.Duration) {
+			defer wg.Done()
+			time.Sleep(delay)
+			w.ContainerStarted(id)
+		}(c.ID, time.Duration(rand.Int63n(int64(w.startupJitter))))
+	}
+	wg.Wait()
 }
 
-func NewWatcher(client *docker.Client, weave *weaveapi.Client, driver *driver) (Watcher, error) {
-	w := &watcher{client: client, weave: weave, driver: driver}
-	return w, client.AddObserver(w)
+func init() {
+	rand.Seed(time.Now().UTC().UnixNano())
+}
+
+// RFC 1035 section 2.3.1 label syntax, relaxed by RFC 1123 section 2.1
+// to allow a leading digit
+var domainLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// ValidateDomain checks that domain is a sequence of valid DNS labels,
+// so that names made by prefixing it with a hostname are well-formed.
+// The absolute form with a trailing dot, as weaveDNS writes its own
+// domain, is accepted too.
+func ValidateDomain(domain string) error {
+	if len(domain) > 253 {
+		return fmt.Errorf("invalid domain %q: longer than 253 characters", domain)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if !domainLabel.MatchString(label) {
+			return fmt.Errorf("invalid domain %q: bad label %q", domain, label)
+		}
+	}
+	return nil
+}
+
+// Register with weaveDNS all running containers created at or after 'since'
+func (w *watcher) RegisterAllExisting(since time.Time) error {
+	containers, err := w.client.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		if time.Unix(c.Created, 0).Before(since) {
+			continue
+		}
+		w.ContainerStarted(c.ID)
+	}
+	return nil
+}
+
+// Forget stored registrations of containers which stopped or restarted
+// while the plugin was down.  weaveDNS dropped their names when they
+// died, so any that are running again need registering afresh.
+func (w *watcher) reconcile() error {
+	stored, err := w.store.List()
+	if err != nil {
+		return err
+	}
+	for _, r := range stored {
+		info, err := w.client.InspectContainer(r.ContainerID)
+		if err == nil && info.State.Running && info.State.StartedAt.Equal(r.StartedAt) {
+			continue
+		}
+		if err := w.store.Delete(r.ContainerID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (w *watcher) ContainerStarted(id string) {
@@ -32,20 +209,155 @@ func (w *watcher) ContainerStarted(id string) {
 		w.driver.warn("ContainerStarted", "error inspecting container %s: %s", id, err)
 		return
 	}
-	// check that it's on our network, via the endpointID
-	for _, net := range info.NetworkSettings.Networks {
-		if w.driver.HasEndpoint(net.EndpointID) {
-			fqdn := fmt.Sprintf("%s.%s", info.Config.Hostname, info.Config.Domainname)
-			if err := w.weave.RegisterWithDNS(id, fqdn, net.IPAddress); err != nil {
+	// Some Docker versions send duplicate 'start' events, and the
+	// startup scan can overlap with events for the same container
+	if !w.claim(id, info.State.StartedAt) {
+		w.driver.debug("ContainerStarted", "%s already registered with weaveDNS", id)
+		return
+	}
+	defer w.release(id)
+	domainname := info.Config.Domainname
+	if domainname == "" {
+		domainname = w.domain
+	}
+	fqdn := fmt.Sprintf("%s.%s", info.Config.Hostname, domainname)
+	registered := RegisteredContainer{ContainerID: id, FQDN: fqdn, StartedAt: info.State.StartedAt}
+	failed := false
+	for _, network := range info.NetworkSettings.Networks {
+		if w.isWeaveNetwork(network) {
+			if err := w.weave.RegisterWithDNS(id, fqdn, network.IPAddress); err != nil {
 				w.driver.warn("ContainerStarted", "unable to register %s with weaveDNS: %s", id, err)
+				failed = true
+				continue
+			}
+			registered.IPs = append(registered.IPs, net.ParseIP(network.IPAddress))
+			for _, alias := range aliasFQDNs(id, network.Aliases, fqdn, domainname) {
+				if err := w.weave.RegisterWithDNS(id, alias, network.IPAddress); err != nil {
+					w.driver.warn("ContainerStarted", "unable to register alias %s of %s with weaveDNS: %s", alias, id, err)
+					failed = true
+					continue
+				}
+				registered.addAlias(alias)
 			}
 		}
 	}
+	// Leave a partial registration unrecorded so a later start retries it;
+	// weaveDNS ignores names it already has
+	if len(registered.IPs) > 0 && !failed {
+		w.setRegistered(registered)
+	}
+}
+
+// Endpoints created since we started are known to the driver; for
+// others, e.g. from before a restart, ask Docker which driver owns the
+// network
+func (w *watcher) isWeaveNetwork(network docker.ContainerNetwork) bool {
+	if w.driver.HasEndpoint(network.EndpointID) {
+		return true
+	}
+	w.Lock()
+	ours, found := w.networks[network.NetworkID]
+	w.Unlock()
+	if found {
+		return ours
+	}
+	info, err := w.client.NetworkInfo(network.NetworkID)
+	if err != nil {
+		w.driver.warn("ContainerStarted", "unable to inspect network %s: %s", network.NetworkID, err)
+		return false
+	}
+	ours = info.Driver == w.driver.name
+	w.Lock()
+	w.networks[network.NetworkID] = ours
+	w.Unlock()
+	return ours
+}
+
+// Qualify network aliases with the container's domain, skipping any
+// that duplicate the primary name, and the short container ID which
+// Docker adds on user-defined networks.  Aliases which already contain
+// a dot are taken to be fully-qualified.
+func aliasFQDNs(id string, aliases []string, fqdn, domainname string) []string {
+	shortID := id
+	if len(shortID) > 12 {
+		shortID = shortID[:12]
+	}
+	var result []string
+	for _, alias := range aliases {
+		if alias == shortID {
+			continue
+		}
+		if !strings.Contains(alias, ".") {
+			alias = fmt.Sprintf("%s.%s", alias, domainname)
+		}
+		if alias != fqdn {
+			result = append(result, alias)
+		}
+	}
+	return result
+}
+
+func (r *RegisteredContainer) addAlias(alias string) {
+	for _, a := range r.Aliases {
+		if a == alias {
+			return
+		}
+	}
+	r.Aliases = append(r.Aliases, alias)
 }
 
 func (w *watcher) ContainerDied(id string) {
-	// don't need to do this as WeaveDNS removes names on container died anyway
+	// don't need to deregister as WeaveDNS removes names on container died anyway
 	// (note by the time we get this event we can't see the EndpointID)
+	if err := w.store.Delete(id); err != nil {
+		w.driver.warn("ContainerDied", "unable to forget registration of %s: %s", id, err)
+	}
 }
 
 func (w *watcher) ContainerDestroyed(id string) {}
+
+// Take ownership of registering the run of id which started at
+// startedAt, unless that run is already registered or another goroutine
+// is part-way through registering it.  Comparing start times means a
+// restarted container is registered again even if we missed its 'die'
+// event, e.g. while resubscribing to Docker events.
+func (w *watcher) claim(id string, startedAt time.Time) bool {
+	w.Lock()
+	defer w.Unlock()
+	if pending, found := w.pending[id]; found && pending.Equal(startedAt) {
+		return false
+	}
+	if r, found := w.registration(id); found && r.StartedAt.Equal(startedAt) {
+		return false
+	}
+	w.pending[id] = startedAt
+	return true
+}
+
+func (w *watcher) release(id string) {
+	w.Lock()
+	delete(w.pending, id)
+	w.Unlock()
+}
+
+func (w *watcher) registration(id string) (RegisteredContainer, bool) {
+	r, found, err := w.store.Get(id)
+	if err != nil {
+		w.driver.warn("ContainerStarted", "unable to look up registration of %s: %s", id, err)
+	}
+	return r, found
+}
+
+func (w *watcher) setRegistered(r RegisteredContainer) {
+	if err := w.store.Put(r.ContainerID, r); err != nil {
+		w.driver.warn("ContainerStarted", "unable to record registration of %s: %s", r.ContainerID, err)
+	}
+}
+
+func (w *watcher) ListRegisteredContainers() []RegisteredContainer {
+	registered, err := w.store.List()
+	if err != nil {
+		w.driver.warn("ListRegisteredContainers", "%s", err)
+	}
+	return registered
+}
@@ -0,0 +1,213 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAliasFQDNs(t *testing.T) {
+	aliases := []string{"db", "postgres.weave.local", "c1"}
+	require.Equal(t,
+		[]string{"db.weave.local", "postgres.weave.local"},
+		aliasFQDNs("c1", aliases, "c1.weave.local", "weave.local"))
+	require.Nil(t, aliasFQDNs("c1", nil, "c1.weave.local", "weave.local"))
+}
+
+func TestContainerStarted(t *testing.T) {
+	dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+	w, err := newWatcher(dockerClient, weave, newTestDriver("ep1"), WithDomain(WeaveDomain))
+	require.NoError(t, err)
+	require.Len(t, dockerClient.observers, 1)
+
+	dockerClient.addContainer("c1", "db", "", map[string]string{"ep1": "10.32.0.1", "ep-other": "172.17.0.2"})
+	w.ContainerStarted("c1")
+	require.Equal(t, []string{"c1 10.32.0.1"}, weave.lookup("db.weave.local"))
+	require.Equal(t,
+		[]RegisteredContainer{{ContainerID: "c1", FQDN: "db.weave.local", IPs: []net.IP{net.ParseIP("10.32.0.1")}, StartedAt: testStartedAt}},
+		w.ListRegisteredContainers())
+
+	// Container's own domain name takes precedence
+	dockerClient.addContainer("c2", "web", "example.com", map[string]string{"ep1": "10.32.0.2"})
+	w.ContainerStarted("c2")
+	require.Equal(t, []string{"c2 10.32.0.2"}, weave.lookup("web.example.com"))
+
+	// Containers not on a weave network are ignored
+	dockerClient.addContainer("c3", "other", "", map[string]string{"ep-other": "172.17.0.3"})
+	w.ContainerStarted("c3")
+	require.Len(t, w.ListRegisteredContainers(), 2)
+
+	// As are containers Docker can't tell us about
+	w.ContainerStarted("nonexistent")
+	require.Len(t, w.ListRegisteredContainers(), 2)
+}
+
+func TestContainerStartedAliases(t *testing.T) {
+	dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+	w, err := newWatcher(dockerClient, weave, newTestDriver("ep1"), WithDomain(WeaveDomain))
+	require.NoError(t, err)
+
+	// Docker adds the short container ID as an alias on user-defined networks
+	id := strings.Repeat("0123456789abcdef", 4)
+	dockerClient.addContainer(id, "db", "", map[string]string{"ep1": "10.32.0.1"}, "pg", "postgres.example.com", "primary", id[:12])
+	w.ContainerStarted(id)
+	aliases := []string{"pg.weave.local", "postgres.example.com", "primary.weave.local"}
+	for _, alias := range append(aliases, "db.weave.local") {
+		require.Equal(t, []string{id + " 10.32.0.1"}, weave.lookup(alias), alias)
+	}
+	require.Empty(t, weave.lookup(id[:12]+".weave.local"))
+	registered := w.ListRegisteredContainers()
+	require.Len(t, registered, 1)
+	require.Equal(t, aliases, registered[0].Aliases)
+}
+
+func TestContainerStartedDNSErrors(t *testing.T) {
+	for _, regErr := range []error{errors.New("400 Bad Request: invalid fqdn"), errWeaveDown} {
+		dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+		w, err := newWatcher(dockerClient, weave, newTestDriver("ep1"), WithDomain(WeaveDomain))
+		require.NoError(t, err)
+
+		weave.err = regErr
+		dockerClient.addContainer("c1", "db", "", map[string]string{"ep1": "10.32.0.1"})
+		w.ContainerStarted("c1")
+		require.Empty(t, w.ListRegisteredContainers(), regErr.Error())
+
+		// Not recorded as registered, so a later start is retried
+		weave.err = nil
+		w.ContainerStarted("c1")
+		require.Equal(t, []string{"c1 10.32.0.1"}, weave.lookup("db.weave.local"))
+	}
+}
+
+func TestContainerStartedPartialFailure(t *testing.T) {
+	dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+	w, err := newWatcher(dockerClient, weave, newTestDriver("ep1", "ep2"), WithDomain(WeaveDomain))
+	require.NoError(t, err)
+
+	weave.err, weave.errIP = errWeaveDown, "10.40.0.1"
+	dockerClient.addContainer("c1", "db", "", map[string]string{"ep1": "10.32.0.1", "ep2": "10.40.0.1"})
+	w.ContainerStarted("c1")
+	require.Equal(t, []string{"c1 10.32.0.1"}, weave.lookup("db.weave.local"))
+	require.Empty(t, w.ListRegisteredContainers())
+
+	// The network that failed is retried on the next start
+	weave.err = nil
+	w.ContainerStarted("c1")
+	require.Contains(t, weave.lookup("db.weave.local"), "c1 10.40.0.1")
+	require.Len(t, w.ListRegisteredContainers(), 1)
+}
+
+func TestContainerStartedConcurrent(t *testing.T) {
+	dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+	w, err := newWatcher(dockerClient, weave, newTestDriver("ep1"), WithDomain(WeaveDomain))
+	require.NoError(t, err)
+
+	dockerClient.addContainer("c1", "db", "", map[string]string{"ep1": "10.32.0.1"})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.ContainerStarted("c1")
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, []string{"c1 10.32.0.1"}, weave.lookup("db.weave.local"))
+}
+
+func TestContainerStartedDuplicate(t *testing.T) {
+	dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+	dockerClient.addContainer("c1", "db", "", map[string]string{"ep1": "10.32.0.1"})
+	// Existing containers are registered by the startup scan
+	w, err := newWatcher(dockerClient, weave, newTestDriver("ep1"), WithDomain(WeaveDomain))
+	require.NoError(t, err)
+	w.registerExisting()
+	require.Equal(t, []string{"c1 10.32.0.1"}, weave.lookup("db.weave.local"))
+
+	w.ContainerStarted("c1")
+	require.Equal(t, []string{"c1 10.32.0.1"}, weave.lookup("db.weave.local"))
+}
+
+func TestContainerRestartedWithoutDied(t *testing.T) {
+	dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+	w, err := newWatcher(dockerClient, weave, newTestDriver("ep1"), WithDomain(WeaveDomain))
+	require.NoError(t, err)
+
+	dockerClient.addContainer("c1", "db", "", map[string]string{"ep1": "10.32.0.1"})
+	w.ContainerStarted("c1")
+	// The 'die' event was missed, but the new run is still registered
+	dockerClient.restartContainer("c1")
+	w.ContainerStarted("c1")
+	require.Len(t, weave.lookup("db.weave.local"), 2)
+	registered := w.ListRegisteredContainers()
+	require.Len(t, registered, 1)
+	require.Equal(t, testStartedAt.Add(time.Minute), registered[0].StartedAt)
+}
+
+func TestRegisterExistingAfterRestart(t *testing.T) {
+	dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+	dockerClient.addNetwork("net-ep1", "weave")
+	dockerClient.addNetwork("net-ep-other", "bridge")
+	dockerClient.addContainer("c1", "db", "", map[string]string{"ep1": "10.32.0.1", "ep-other": "172.17.0.2"})
+	dockerClient.addContainer("c2", "web", "", map[string]string{"ep-other": "172.17.0.3"})
+
+	// A freshly-started driver knows of no endpoints, so the weave
+	// network must be recognised by its driver
+	w, err := newWatcher(dockerClient, weave, newTestDriver(), WithDomain(WeaveDomain))
+	require.NoError(t, err)
+	w.registerExisting()
+	require.Equal(t, []string{"c1 10.32.0.1"}, weave.lookup("db.weave.local"))
+	require.Empty(t, weave.lookup("web.weave.local"))
+	require.Len(t, w.ListRegisteredContainers(), 1)
+}
+
+func TestRegisterExistingWithJitter(t *testing.T) {
+	dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+	for i := 1; i <= 5; i++ {
+		dockerClient.addContainer(fmt.Sprintf("c%d", i), fmt.Sprintf("host%d", i), "", map[string]string{"ep1": fmt.Sprintf("10.32.0.%d", i)})
+	}
+	w, err := newWatcher(dockerClient, weave, newTestDriver("ep1"), WithDomain(WeaveDomain), WithStartupJitter(50*time.Millisecond))
+	require.NoError(t, err)
+
+	w.registerExisting()
+	for i := 1; i <= 5; i++ {
+		require.Equal(t, []string{fmt.Sprintf("c%d 10.32.0.%d", i, i)}, weave.lookup(fmt.Sprintf("host%d.weave.local", i)))
+	}
+	require.Len(t, w.ListRegisteredContainers(), 5)
+}
+
+func TestContainerDied(t *testing.T) {
+	dockerClient, weave := newMockDockerClient(), newMockWeaveClient()
+	w, err := newWatcher(dockerClient, weave, newTestDriver("ep1"), WithDomain(WeaveDomain))
+	require.NoError(t, err)
+
+	dockerClient.addContainer("c1", "db", "", map[string]string{"ep1": "10.32.0.1"})
+	w.ContainerStarted("c1")
+	w.ContainerDied("c1")
+	require.Empty(t, w.ListRegisteredContainers())
+
+	// A restarted container is registered again
+	w.ContainerStarted("c1")
+	require.Len(t, w.ListRegisteredContainers(), 1)
+	require.Len(t, weave.lookup("db.weave.local"), 2)
+}
+
+func TestValidateDomain(t *testing.T) {
+	for _, domain := range []string{"weave.local", "example.com", "a", "my-domain.x1", "1weave.local", "3com.com", "1password.com", "weave.local."} {
+		require.NoError(t, ValidateDomain(domain), domain)
+	}
+	for _, domain := range []string{"", ".", "weave.local..", "weave..local", "we ave.local", "-weave.local", "weave-.local", strings.Repeat("a", 64) + ".local"} {
+		require.Error(t, ValidateDomain(domain), domain)
+	}
+
+	_, err := newWatcher(newMockDockerClient(), newMockWeaveClient(), newTestDriver(), WithDomain("weave.local."))
+	require.NoError(t, err)
+	_, err = newWatcher(newMockDockerClient(), newMockWeaveClient(), newTestDriver(), WithDomain("bad domain"))
+	require.Error(t, err)
+}
@@ -7,14 +7,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	cni "github.com/appc/cni/pkg/skel"
 	"github.com/docker/libnetwork/ipamapi"
 	weaveapi "github.com/weaveworks/weave/api"
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/db"
 	weavenet "github.com/weaveworks/weave/net"
 	ipamplugin "github.com/weaveworks/weave/plugin/ipam"
 	netplugin "github.com/weaveworks/weave/plugin/net"
@@ -34,6 +37,8 @@ func main() {
 		meshAddress      string
 		logLevel         string
 		noMulticastRoute bool
+		dnsJitter        time.Duration
+		dbPrefix         string
 	)
 
 	flag.BoolVar(&justVersion, "version", false, "print version and exit")
@@ -43,6 +48,8 @@ func main() {
 	flag.StringVar(&address, "socket", "/run/docker/plugins/weave.sock", "socket on which to listen")
 	flag.StringVar(&meshAddress, "meshsocket", "/run/docker/plugins/weavemesh.sock", "socket on which to listen in mesh mode")
 	flag.BoolVar(&noMulticastRoute, "no-multicast-route", false, "deprecated (this is now the default)")
+	flag.StringVar(&dbPrefix, "db-prefix", "/weavedb/weave", "pathname/prefix of filename to store data")
+	flag.DurationVar(&dnsJitter, "dns-startup-jitter", 0, "spread DNS registration of already-running containers over this long")
 
 	flag.Parse()
 
@@ -78,16 +85,23 @@ func main() {
 	}
 	Log.Info(dockerClient.Info())
 
-	err = run(dockerClient, weave, address, meshAddress)
+	// Separate from the router's file, which it holds locked
+	var pluginDB db.DB
+	if pluginDB, err = db.NewBoltDB(dbPrefix + "plugindata.db"); err != nil {
+		Log.Warningf("DNS registrations will not survive a plugin restart: %s", err)
+		pluginDB = nil
+	}
+
+	err = run(dockerClient, weave, address, meshAddress, pluginDB, netplugin.WithStartupJitter(dnsJitter))
 	if err != nil {
 		Log.Fatal(err)
 	}
 }
 
-func run(dockerClient *docker.Client, weave *weaveapi.Client, address, meshAddress string) error {
+func run(dockerClient *docker.Client, weave *weaveapi.Client, address, meshAddress string, pluginDB db.DB, opts ...netplugin.WatcherOption) error {
 	endChan := make(chan error, 1)
 	if address != "" {
-		globalListener, err := listenAndServe(dockerClient, weave, address, endChan, "global", false)
+		globalListener, err := listenAndServe(dockerClient, weave, address, endChan, "global", false, pluginDB, opts...)
 		if err != nil {
 			return err
 		}
@@ -95,7 +109,7 @@ func run(dockerClient *docker.Client, weave *weaveapi.Client, address, meshAddre
 		defer globalListener.Close()
 	}
 	if meshAddress != "" {
-		meshListener, err := listenAndServe(dockerClient, weave, meshAddress, endChan, "local", true)
+		meshListener, err := listenAndServe(dockerClient, weave, meshAddress, endChan, "local", true, pluginDB, opts...)
 		if err != nil {
 			return err
 		}
@@ -120,21 +134,37 @@ func run(dockerClient *docker.Client, weave *weaveapi.Client, address, meshAddre
 	}
 }
 
-func listenAndServe(dockerClient *docker.Client, weave *weaveapi.Client, address string, endChan chan<- error, scope string, withIpam bool) (net.Listener, error) {
-	d, err := netplugin.New(dockerClient, weave, scope)
+func listenAndServe(dockerClient *docker.Client, weave *weaveapi.Client, address string, endChan chan<- error, scope string, withIpam bool, pluginDB db.DB, opts ...netplugin.WatcherOption) (net.Listener, error) {
+	// Listen first, so Docker can connect while the driver catches up
+	// with existing containers
+	listener, err := weavenet.ListenUnixSocket(address)
 	if err != nil {
 		return nil, err
 	}
 
-	var i ipamapi.Ipam
-	if withIpam {
-		i = ipamplugin.NewIpam(weave)
+	if pluginDB != nil {
+		// Each scope's driver registers only containers on its own networks
+		store, err := netplugin.NewDBRegistrationStore(pluginDB, "dnsregistrations-"+scope)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		opts = append(opts, netplugin.WithRegistrationStore(store))
 	}
 
-	listener, err := weavenet.ListenUnixSocket(address)
+	// Docker knows the driver by the name of its socket
+	name := strings.TrimSuffix(filepath.Base(address), ".sock")
+	d, err := netplugin.New(dockerClient, weave, name, scope, opts...)
 	if err != nil {
+		listener.Close()
 		return nil, err
 	}
+
+	var i ipamapi.Ipam
+	if withIpam {
+		i = ipamplugin.NewIpam(weave)
+	}
+
 	Log.Printf("Listening on %s for %s scope", address, scope)
 
 	go func() {
@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/weaveworks/weave/common/odp"
+	weavenet "github.com/weaveworks/weave/net"
 )
 
 func createDatapath(args []string) error {
@@ -37,3 +38,17 @@ func addDatapathInterface(args []string) error {
 	}
 	return odp.AddDatapathInterface(args[0], args[1])
 }
+
+func checkMTU(args []string) error {
+	if len(args) != 2 {
+		cmdUsage("check-mtu", "<bridge> <datapath>")
+	}
+	consistent, bridgeMTU, datapathMTU, err := weavenet.CheckMTUConsistency(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if !consistent {
+		return fmt.Errorf("MTU of %s (%d) does not match MTU of %s (%d)", args[0], bridgeMTU, args[1], datapathMTU)
+	}
+	return nil
+}
@@ -16,6 +16,7 @@ func init() {
 		"create-datapath":        createDatapath,
 		"delete-datapath":        deleteDatapath,
 		"add-datapath-interface": addDatapathInterface,
+		"check-mtu":              checkMTU,
 		"create-plugin-network":  createPluginNetwork,
 		"remove-plugin-network":  removePluginNetwork,
 		"container-addrs":        containerAddrs,